@@ -0,0 +1,31 @@
+package sync
+
+import (
+	"github.com/QuarkChain/goquarkchain/core/types"
+)
+
+// SyncAPI exposes Synchronizer control to the JSON-RPC layer under the
+// "sync" namespace.
+type SyncAPI struct {
+	sync *Synchronizer
+}
+
+// NewSyncAPI wraps sync for RPC access.
+func NewSyncAPI(sync *Synchronizer) *SyncAPI {
+	return &SyncAPI{sync: sync}
+}
+
+// SetTrustedHead pins the trusted target header used to build the next
+// BeaconTask, regardless of what any connected peer advertises as its best
+// header. It is the JSON-RPC method sync_setTrustedHead, called by a
+// higher-layer consensus/cluster-master component once a header has been
+// finalized.
+func (api *SyncAPI) SetTrustedHead(header types.IHeader) error {
+	return api.sync.SetTrustedHead(header)
+}
+
+// TrustedHead returns the currently pinned trusted target, or nil if none
+// has been set.
+func (api *SyncAPI) TrustedHead() types.IHeader {
+	return api.sync.TrustedHead()
+}
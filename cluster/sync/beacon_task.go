@@ -0,0 +1,120 @@
+package sync
+
+import (
+	"math/big"
+
+	"github.com/QuarkChain/goquarkchain/core/types"
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// beaconPriorityBit is OR'd into a BeaconTask's Priority() above the highest
+// bit any height/TD-derived priority could reach, so a trusted target always
+// outranks every ordinary task in the synchronizer's queue.
+var beaconPriorityBit = new(big.Int).Lsh(big.NewInt(1), 2*priorityHeightBits)
+
+// BeaconTask anchors synchronization to a trusted target header supplied by
+// an external, already-finalized source instead of whatever a connected peer
+// advertises as its best header. Its elevated Priority() only makes it run
+// before other queued tasks; Synchronizer.AddTask is what actually refuses
+// to queue an ordinary task for a rival fork once a trusted head is pinned.
+type BeaconTask struct {
+	*task
+	peers []Peer
+}
+
+// NewBeaconTask builds a Task that trusts header unconditionally: seals for
+// headers at or below it are skipped during validation, and the task's
+// priority is pinned above every ordinary task. peers seeds the set of
+// peers the backfill may pull from beyond whatever SetPeerPool adds later.
+func NewBeaconTask(
+	name string,
+	batchSize int,
+	trusted types.IHeader,
+	peers []Peer,
+	findAncestor func(blockchain) (types.IHeader, error),
+	getHeaders func(types.IHeader) ([]types.IHeader, error),
+	getBlocks func([]common.Hash) ([]types.IBlock, error),
+	syncBlock func(blockchain, types.IBlock) error,
+) *BeaconTask {
+	return &BeaconTask{
+		task: &task{
+			name:          name,
+			batchSize:     batchSize,
+			header:        trusted,
+			trustedHeader: trusted,
+			findAncestor:  findAncestor,
+			getHeaders:    getHeaders,
+			getBlocks:     getBlocks,
+			syncBlock:     syncBlock,
+			needSkip:      func(bc blockchain) bool { return bc.CurrentHeader().NumberU64() >= trusted.NumberU64() },
+		},
+		peers: peers,
+	}
+}
+
+// SetPeerPool merges the synchronizer's peers with the ones the task was
+// explicitly constructed with.
+func (t *BeaconTask) SetPeerPool(pool PeerPool) {
+	t.task.SetPeerPool(&mergedPeerPool{extra: t.peers, base: pool})
+}
+
+// Priority always outranks ordinary height/TD-based tasks.
+func (t *BeaconTask) Priority() *big.Int {
+	return new(big.Int).Or(beaconPriorityBit, t.task.Priority())
+}
+
+// trustedTargetTask is implemented by Tasks that are themselves the reason a
+// trusted head is pinned, so Synchronizer.AddTask's conflict check exempts
+// them instead of rejecting the very task that's setting the trusted head.
+type trustedTargetTask interface {
+	trustedTarget() bool
+}
+
+func (t *BeaconTask) trustedTarget() bool { return true }
+
+// mergedPeerPool presents the union of an explicit peer list and a
+// synchronizer's PeerPool, preferring the explicit list on ID collisions.
+type mergedPeerPool struct {
+	extra []Peer
+	base  PeerPool
+}
+
+func (m *mergedPeerPool) Peer(id string) Peer {
+	for _, p := range m.extra {
+		if p.ID() == id {
+			return p
+		}
+	}
+	if m.base != nil {
+		return m.base.Peer(id)
+	}
+	return nil
+}
+
+func (m *mergedPeerPool) Peers() []Peer {
+	seen := make(map[string]bool, len(m.extra))
+	peers := make([]Peer, 0, len(m.extra))
+	for _, p := range m.extra {
+		seen[p.ID()] = true
+		peers = append(peers, p)
+	}
+	if m.base != nil {
+		for _, p := range m.base.Peers() {
+			if !seen[p.ID()] {
+				peers = append(peers, p)
+			}
+		}
+	}
+	return peers
+}
+
+func (m *mergedPeerPool) BestPeer() Peer {
+	var best Peer
+	var bestNum uint64
+	for _, p := range m.Peers() {
+		if _, num := p.Head(); best == nil || num > bestNum {
+			best, bestNum = p, num
+		}
+	}
+	return best
+}
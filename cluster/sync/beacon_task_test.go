@@ -0,0 +1,58 @@
+package sync
+
+import (
+	"testing"
+
+	"github.com/QuarkChain/goquarkchain/core/types"
+	"github.com/ethereum/go-ethereum/common"
+)
+
+func TestBeaconTaskPriorityOutranksOrdinaryTasks(t *testing.T) {
+	beacon := NewBeaconTask("beacon", 10, &fakeHeader{num: 5}, nil,
+		func(blockchain) (types.IHeader, error) { return &fakeHeader{num: 0}, nil },
+		func(types.IHeader) ([]types.IHeader, error) { return nil, nil },
+		func([]common.Hash) ([]types.IBlock, error) { return nil, nil },
+		nil,
+	)
+	ordinary := &fakeTask{peerID: "ordinary", header: &fakeHeader{num: 1 << 40}, diff: 0}
+
+	if beacon.Priority().Cmp(ordinary.Priority()) <= 0 {
+		t.Fatalf("expected the beacon task to outrank an ordinary task at any height")
+	}
+}
+
+func TestBeaconTaskSkipsSealValidationAtOrBelowTrustedHeader(t *testing.T) {
+	trusted := &fakeHeader{num: 10}
+	tsk := &task{trustedHeader: trusted}
+
+	v := &countingValidator{}
+	bc := &validatingBlockchain{fakeBlockchain: fakeBlockchain{current: &fakeHeader{num: 0}}, validator: v}
+
+	if err := tsk.validateHeaderList(bc, []types.IHeader{&fakeHeader{num: 10}}); err != nil {
+		t.Fatalf("validateHeaderList: %v", err)
+	}
+	if v.calls != 0 {
+		t.Fatalf("expected ValidateSeal to be skipped at the trusted header, got %d calls", v.calls)
+	}
+
+	if err := tsk.validateHeaderList(bc, []types.IHeader{&fakeHeader{num: 11}}); err != nil {
+		t.Fatalf("validateHeaderList: %v", err)
+	}
+	if v.calls != 1 {
+		t.Fatalf("expected ValidateSeal to run for the header above the trusted header, got %d calls", v.calls)
+	}
+}
+
+type countingValidator struct{ calls int }
+
+func (v *countingValidator) ValidateSeal(types.IHeader, bool) error {
+	v.calls++
+	return nil
+}
+
+type validatingBlockchain struct {
+	fakeBlockchain
+	validator *countingValidator
+}
+
+func (bc *validatingBlockchain) Validator() *countingValidator { return bc.validator }
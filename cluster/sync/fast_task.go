@@ -0,0 +1,215 @@
+package sync
+
+import (
+	"fmt"
+	"time"
+
+	qkcom "github.com/QuarkChain/goquarkchain/common"
+	"github.com/QuarkChain/goquarkchain/cluster/sync/statesync"
+	"github.com/QuarkChain/goquarkchain/core/types"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/log"
+)
+
+// pivotOffset is how far behind the remote head the fast-sync pivot block is
+// chosen.
+const pivotOffset = 64
+
+// pivotStalenessCheckInterval controls how often downloadPivotState checks
+// whether the remote head has drifted past pivot+maxSyncStaleness. A var,
+// not a const, so tests can shrink it instead of waiting on the real clock.
+var pivotStalenessCheckInterval = 5 * time.Second
+
+// FastSyncTask pages headers from the common ancestor up to a pivot block,
+// fetches the full state trie for that pivot instead of re-executing
+// everything up to it, commits the pivot as the chain head, and resumes
+// normal execution from there. Bodies and receipts of blocks below the pivot
+// are not downloaded.
+type FastSyncTask struct {
+	*task
+
+	nodePeers  func() []statesync.Peer
+	newStateDB func(root common.Hash) (statesync.Database, error)
+}
+
+// NewFastSyncTask builds a fast-sync Task on top of the ordinary sequential
+// task.
+func NewFastSyncTask(
+	name string,
+	maxSyncStaleness uint64,
+	batchSize int,
+	header types.IHeader,
+	findAncestor func(blockchain) (types.IHeader, error),
+	getHeaders func(types.IHeader) ([]types.IHeader, error),
+	getBlocks func([]common.Hash) ([]types.IBlock, error),
+	syncBlock func(blockchain, types.IBlock) error,
+	needSkip func(blockchain) bool,
+	nodePeers func() []statesync.Peer,
+	newStateDB func(root common.Hash) (statesync.Database, error),
+) *FastSyncTask {
+	return &FastSyncTask{
+		task: &task{
+			name:             name,
+			maxSyncStaleness: maxSyncStaleness,
+			batchSize:        batchSize,
+			header:           header,
+			findAncestor:     findAncestor,
+			getHeaders:       getHeaders,
+			getBlocks:        getBlocks,
+			syncBlock:        syncBlock,
+			needSkip:         needSkip,
+		},
+		nodePeers:  nodePeers,
+		newStateDB: newStateDB,
+	}
+}
+
+// Run finds the common ancestor, downloads state for a pivot near the
+// remote head, commits the pivot as the chain head, then falls back to the
+// ordinary sequential task to execute forward from there.
+func (t *FastSyncTask) Run(bc blockchain) error {
+	if t.needSkip(bc) {
+		return nil
+	}
+
+	ancestor, err := t.findAncestor(bc)
+	if err != nil || qkcom.IsNil(ancestor) {
+		return err
+	}
+
+	pivot, err := t.choosePivot(ancestor)
+	if err != nil {
+		return err
+	}
+
+	logger := log.New("synctask", t.name, "pivot", pivot.NumberU64())
+	committed, err := t.downloadPivotState(logger, pivot)
+	if err != nil {
+		return err
+	}
+
+	if err := bc.FastSyncCommitHead(committed.Hash()); err != nil {
+		return fmt.Errorf("committing fast-sync pivot %d as head: %w", committed.NumberU64(), err)
+	}
+
+	return t.task.Run(bc)
+}
+
+// choosePivot pages forward from ancestor, across as many header batches as
+// needed, to the header at pivotOffset behind the advertised head.
+func (t *FastSyncTask) choosePivot(ancestor types.IHeader) (types.IHeader, error) {
+	target := t.pivotTarget(ancestor.NumberU64())
+	if target <= ancestor.NumberU64() {
+		return ancestor, nil
+	}
+	return t.pageToHeight(ancestor, target)
+}
+
+// pivotTarget is pivotOffset behind the task's target head, floored at
+// floor so the pivot never moves behind state we already have.
+func (t *FastSyncTask) pivotTarget(floor uint64) uint64 {
+	headNum := t.header.NumberU64()
+	if headNum > pivotOffset && headNum-pivotOffset > floor {
+		return headNum - pivotOffset
+	}
+	return floor
+}
+
+// pageToHeight walks getHeaders forward from cursor, one batch at a time,
+// until it reaches a header at or past target, or the chain runs out.
+func (t *FastSyncTask) pageToHeight(cursor types.IHeader, target uint64) (types.IHeader, error) {
+	for cursor.NumberU64() < target {
+		headers, err := t.getHeaders(cursor)
+		if err != nil {
+			return nil, err
+		}
+		if len(headers) == 0 {
+			return cursor, nil
+		}
+		for _, h := range headers {
+			if h.NumberU64() >= target {
+				return h, nil
+			}
+		}
+		cursor = headers[len(headers)-1]
+	}
+	return cursor, nil
+}
+
+// bestRemoteHead returns the tallest head currently advertised by the peer
+// pool, or 0 if none is known.
+func (t *FastSyncTask) bestRemoteHead() uint64 {
+	if t.pool == nil {
+		return 0
+	}
+	best := t.pool.BestPeer()
+	if best == nil {
+		return 0
+	}
+	_, num := best.Head()
+	return num
+}
+
+// downloadPivotState retrieves the account trie, every contract's storage
+// trie, and contract code for the pivot's state root, and returns the header
+// the downloaded state actually belongs to. If the remote head advances past
+// pivot+maxSyncStaleness while that's in flight, it cancels the download and
+// restarts against a fresher pivot, so the returned header may not be the
+// one it was originally called with.
+func (t *FastSyncTask) downloadPivotState(logger log.Logger, pivot types.IHeader) (types.IHeader, error) {
+	for {
+		root := pivot.GetStateRoot()
+		db, err := t.newStateDB(root)
+		if err != nil {
+			return nil, fmt.Errorf("opening state db for pivot %d: %w", pivot.NumberU64(), err)
+		}
+
+		sched := statesync.NewScheduler(root, db)
+		for _, p := range t.nodePeers() {
+			sched.RegisterPeer(p)
+		}
+
+		logger.Info("Downloading pivot state", "root", root, "peers", len(t.nodePeers()))
+		fresher, err := t.watchPivotDownload(sched, pivot)
+		if err != nil {
+			return nil, fmt.Errorf("downloading state for pivot %d: %w", pivot.NumberU64(), err)
+		}
+		if fresher == nil {
+			logger.Info("Pivot state download complete", "root", root)
+			return pivot, nil
+		}
+
+		logger.Info("Remote head drifted past staleness window, restarting with a fresher pivot", "oldPivot", pivot.NumberU64(), "newPivot", fresher.NumberU64())
+		pivot = fresher
+		logger = log.New("synctask", t.name, "pivot", pivot.NumberU64())
+	}
+}
+
+// watchPivotDownload runs sched to completion unless the remote head drifts
+// past pivot+maxSyncStaleness first, in which case it cancels sched and
+// returns the header state should be re-downloaded for instead.
+func (t *FastSyncTask) watchPivotDownload(sched *statesync.Scheduler, pivot types.IHeader) (types.IHeader, error) {
+	done := make(chan error, 1)
+	go func() { done <- sched.Run() }()
+
+	ticker := time.NewTicker(pivotStalenessCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case err := <-done:
+			if err != nil && err != statesync.ErrCancelled {
+				return nil, err
+			}
+			return nil, nil
+		case <-ticker.C:
+			head := t.bestRemoteHead()
+			if head == 0 || head <= pivot.NumberU64()+t.maxSyncStaleness {
+				continue
+			}
+			sched.Stop()
+			<-done
+			return t.pageToHeight(pivot, head-pivotOffset)
+		}
+	}
+}
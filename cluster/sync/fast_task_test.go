@@ -0,0 +1,65 @@
+package sync
+
+import (
+	"time"
+
+	"testing"
+
+	"github.com/QuarkChain/goquarkchain/cluster/sync/statesync"
+	"github.com/QuarkChain/goquarkchain/core/types"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/log"
+)
+
+// fakeStateDB is a no-op statesync.Database: downloadPivotState only needs
+// somewhere to hand node bytes, and this test never lets any nodes arrive.
+type fakeStateDB struct{}
+
+func (fakeStateDB) Put(key, value []byte) error { return nil }
+
+// TestDownloadPivotStateRestartsOnStaleness exercises the "moving target"
+// path: the remote head drifts past pivot+maxSyncStaleness while state is
+// still downloading, so downloadPivotState must cancel, re-pivot, and
+// return the header it actually finished downloading state for rather than
+// the stale one it started with.
+func TestDownloadPivotStateRestartsOnStaleness(t *testing.T) {
+	orig := pivotStalenessCheckInterval
+	pivotStalenessCheckInterval = 15 * time.Millisecond
+	defer func() { pivotStalenessCheckInterval = orig }()
+
+	peer := &fakeQueuePeer{id: "p1", head: 50, throughput: 10}
+	pool := &fakeQueuePool{peers: []*fakeQueuePeer{peer}}
+
+	stalePivot := &fakeHeader{num: 60, stateRoot: common.HexToHash("0xaa")}
+	fresherPivot := &fakeHeader{num: 76} // zero state root: its download completes instantly
+
+	task := &FastSyncTask{
+		task: &task{
+			name:             "fast",
+			maxSyncStaleness: 70,
+			pool:             pool,
+			getHeaders: func(types.IHeader) ([]types.IHeader, error) {
+				return []types.IHeader{fresherPivot}, nil
+			},
+		},
+		nodePeers:  func() []statesync.Peer { return nil },
+		newStateDB: func(common.Hash) (statesync.Database, error) { return fakeStateDB{}, nil },
+	}
+
+	// Bump the advertised remote head past stalePivot+maxSyncStaleness (130)
+	// shortly after the download starts, once the first staleness check has
+	// already seen the original, non-stale head.
+	go func() {
+		time.Sleep(25 * time.Millisecond)
+		peer.SetHead(140)
+	}()
+
+	logger := log.New("test", "fast-sync-staleness")
+	committed, err := task.downloadPivotState(logger, stalePivot)
+	if err != nil {
+		t.Fatalf("downloadPivotState: %v", err)
+	}
+	if committed.NumberU64() != fresherPivot.NumberU64() {
+		t.Fatalf("expected the fresher pivot %d to be returned for commit, got %d", fresherPivot.NumberU64(), committed.NumberU64())
+	}
+}
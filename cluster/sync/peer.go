@@ -0,0 +1,26 @@
+package sync
+
+import (
+	"github.com/QuarkChain/goquarkchain/core/types"
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// Peer is the capability a sync task needs from a single connected remote
+// node: fetch headers/bodies for it and report how fast it has been.
+type Peer interface {
+	ID() string
+	Head() (common.Hash, uint64)
+	GetHeaders(origin types.IHeader, amount, skip int, reverse bool) ([]types.IHeader, error)
+	GetBlocks(hashes []common.Hash) ([]types.IBlock, error)
+
+	// Throughput is a rolling estimate of blocks served per second.
+	Throughput() float64
+}
+
+// PeerPool gives a Task access to every peer the synchronizer currently
+// knows about, not just the one it was originally created against.
+type PeerPool interface {
+	Peer(id string) Peer
+	Peers() []Peer
+	BestPeer() Peer
+}
@@ -0,0 +1,202 @@
+package sync
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	qkcom "github.com/QuarkChain/goquarkchain/common"
+	"github.com/QuarkChain/goquarkchain/core/types"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/log"
+)
+
+// pipelineWindow is the buffer capacity of each channel between stages: up
+// to that many fetched header batches may wait for validation, that many
+// validated batches for block download, and that many block chunks for
+// apply, so the header fetcher can run ahead of the network link and CPU
+// without either stage sitting idle waiting on the other.
+const pipelineWindow = 4
+
+// headerBatch is one hop of headers produced by the header-fetch stage and
+// consumed by the validation stage.
+type headerBatch struct {
+	from    types.IHeader
+	headers []types.IHeader
+}
+
+// blockBatch is one chunk of blocks produced by the block-fetch stage and
+// consumed by the apply stage, tagged with the height of the last header in
+// its parent headerBatch, so progress reports name the end of the whole
+// header batch as the highest block, not the end of this chunk.
+type blockBatch struct {
+	blocks    []types.IBlock
+	batchBest uint64
+}
+
+// runPipeline runs the fetch/validate/fetch/apply stages concurrently,
+// connected by bounded channels. Any stage's error cancels the rest via ctx.
+func (t *task) runPipeline(bc blockchain, ancestor types.IHeader, q *queue, logger log.Logger) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	headerCh := make(chan headerBatch, pipelineWindow)
+	validatedCh := make(chan headerBatch, pipelineWindow)
+	blockCh := make(chan blockBatch, pipelineWindow)
+
+	var (
+		wg       sync.WaitGroup
+		errOnce  sync.Once
+		firstErr error
+	)
+	fail := func(err error) {
+		if err == nil {
+			return
+		}
+		errOnce.Do(func() { firstErr = err })
+		cancel()
+	}
+
+	wg.Add(4)
+	go func() { defer wg.Done(); fail(t.pipelineFetchHeaders(ctx, q, ancestor, headerCh)) }()
+	go func() { defer wg.Done(); fail(t.pipelineValidateHeaders(ctx, bc, headerCh, validatedCh)) }()
+	go func() { defer wg.Done(); fail(t.pipelineFetchBlocks(ctx, q, logger, validatedCh, blockCh)) }()
+	go func() { defer wg.Done(); fail(t.pipelineApplyBlocks(ctx, bc, blockCh)) }()
+
+	wg.Wait()
+	return firstErr
+}
+
+// pipelineFetchHeaders is stage 1: it fetches headers continuously,
+// advancing the ancestor cursor after every batch, until the chain runs out
+// of new headers or the pipeline is cancelled.
+func (t *task) pipelineFetchHeaders(ctx context.Context, q *queue, ancestor types.IHeader, out chan<- headerBatch) error {
+	defer close(out)
+
+	for !qkcom.IsNil(ancestor) {
+		headers, err := t.fetchHeaders(q, ancestor)
+		if err != nil {
+			return err
+		}
+		if len(headers) == 0 {
+			return nil
+		}
+
+		batch := headerBatch{from: ancestor, headers: headers}
+		select {
+		case out <- batch:
+		case <-ctx.Done():
+			return nil
+		}
+		ancestor = headers[len(headers)-1]
+	}
+	return nil
+}
+
+// pipelineValidateHeaders is stage 2: it validates each header batch as it
+// arrives.
+func (t *task) pipelineValidateHeaders(ctx context.Context, bc blockchain, in <-chan headerBatch, out chan<- headerBatch) error {
+	defer close(out)
+
+	for {
+		select {
+		case batch, ok := <-in:
+			if !ok {
+				return nil
+			}
+			if err := t.validateHeaderList(bc, batch.headers); err != nil {
+				return err
+			}
+			select {
+			case out <- batch:
+			case <-ctx.Done():
+				return nil
+			}
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+// pipelineFetchBlocks is stage 3: for every validated header batch it
+// downloads bodies in batchSize-sized chunks.
+func (t *task) pipelineFetchBlocks(ctx context.Context, q *queue, logger log.Logger, in <-chan headerBatch, out chan<- blockBatch) error {
+	defer close(out)
+
+	for {
+		select {
+		case batch, ok := <-in:
+			if !ok {
+				return nil
+			}
+			if err := t.fetchBlockBatch(ctx, q, logger, batch, out); err != nil {
+				return err
+			}
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+func (t *task) fetchBlockBatch(ctx context.Context, q *queue, logger log.Logger, batch headerBatch, out chan<- blockBatch) error {
+	hashlist := make([]common.Hash, 0, len(batch.headers))
+	for _, hd := range batch.headers {
+		hashlist = append(hashlist, hd.Hash())
+	}
+	batchBest := batch.headers[len(batch.headers)-1].NumberU64()
+	logger.Info("Downloading blocks", "length", len(batch.headers), "from", batch.from.NumberU64(), "to", batchBest)
+
+	for len(hashlist) > 0 {
+		chunk := hashlist
+		if len(chunk) > t.batchSize {
+			chunk = hashlist[:t.batchSize]
+		}
+
+		blocks, err := t.fetchBlocks(q, chunk)
+		if err != nil {
+			return fmt.Errorf("fetching blocks: %w", err)
+		}
+		if len(blocks) != len(chunk) {
+			return fmt.Errorf("unmatched block length, expect: %d, actual: %d", len(chunk), len(blocks))
+		}
+		hashlist = hashlist[len(chunk):]
+
+		select {
+		case out <- blockBatch{blocks: blocks, batchBest: batchBest}:
+		case <-ctx.Done():
+			return nil
+		}
+	}
+	return nil
+}
+
+// pipelineApplyBlocks is stage 4: it drains block batches strictly in the
+// order they were produced and applies them to bc.
+func (t *task) pipelineApplyBlocks(ctx context.Context, bc blockchain, in <-chan blockBatch) error {
+	counter := 0
+	for {
+		select {
+		case batch, ok := <-in:
+			if !ok {
+				return nil
+			}
+			for _, blk := range batch.blocks {
+				if t.syncBlock != nil {
+					if err := t.syncBlock(bc, blk); err != nil {
+						return err
+					}
+				}
+				if err := bc.AddBlock(blk); err != nil {
+					return err
+				}
+
+				counter++
+				if counter%100 == 0 {
+					t.sendSync(true, blk.NumberU64(), batch.batchBest)
+				}
+			}
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
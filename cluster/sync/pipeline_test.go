@@ -0,0 +1,112 @@
+package sync
+
+import (
+	"encoding/binary"
+	"errors"
+	"testing"
+
+	"github.com/QuarkChain/goquarkchain/core/types"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/log"
+)
+
+type fakeValidator struct{}
+
+func (fakeValidator) ValidateSeal(types.IHeader, bool) error { return nil }
+
+type fakeBlockchain struct {
+	current types.IHeader
+	applied []uint64
+}
+
+func (bc *fakeBlockchain) CurrentHeader() types.IHeader { return bc.current }
+func (bc *fakeBlockchain) Validator() fakeValidator     { return fakeValidator{} }
+func (bc *fakeBlockchain) AddBlock(blk types.IBlock) error {
+	bc.applied = append(bc.applied, blk.NumberU64())
+	return nil
+}
+func (bc *fakeBlockchain) FastSyncCommitHead(common.Hash) error { return nil }
+
+type fakeBlock struct{ num uint64 }
+
+func (b *fakeBlock) NumberU64() uint64 { return b.num }
+
+func newPagedHeaders(from, to uint64) []types.IHeader {
+	headers := make([]types.IHeader, 0, to-from)
+	for n := from + 1; n <= to; n++ {
+		headers = append(headers, &fakeHeader{num: n})
+	}
+	return headers
+}
+
+// hashToNum lets a test's getBlocks stub recover a fake header's number from
+// the common.Hash the pipeline passes it, since fetchBlockBatch only ever
+// hands blocks downstream hashes, not the original headers.
+func hashToNum(hash common.Hash) uint64 {
+	var buf [8]byte
+	copy(buf[:], hash[common.HashLength-9:common.HashLength-1])
+	return binary.BigEndian.Uint64(buf[:])
+}
+
+func TestPipelineAppliesBlocksInOrder(t *testing.T) {
+	t1 := &task{
+		name:      "t",
+		batchSize: 2,
+		header:    &fakeHeader{num: 6},
+		getHeaders: func(from types.IHeader) ([]types.IHeader, error) {
+			if from.NumberU64() >= 6 {
+				return nil, nil
+			}
+			return newPagedHeaders(from.NumberU64(), 6), nil
+		},
+		getBlocks: func(hashes []common.Hash) ([]types.IBlock, error) {
+			blocks := make([]types.IBlock, len(hashes))
+			for i, h := range hashes {
+				blocks[i] = &fakeBlock{num: hashToNum(h)}
+			}
+			return blocks, nil
+		},
+	}
+
+	bc := &fakeBlockchain{current: &fakeHeader{num: 0}}
+	if err := t1.runPipeline(bc, &fakeHeader{num: 0}, nil, log.New()); err != nil {
+		t.Fatalf("runPipeline: %v", err)
+	}
+
+	if len(bc.applied) != 6 {
+		t.Fatalf("expected 6 blocks applied, got %d: %v", len(bc.applied), bc.applied)
+	}
+	for i, num := range bc.applied {
+		if num != uint64(i+1) {
+			t.Fatalf("expected blocks applied strictly in order, got %v", bc.applied)
+		}
+	}
+}
+
+func TestPipelineCancelsAllStagesOnError(t *testing.T) {
+	wantErr := errors.New("header fetch failed")
+	t1 := &task{
+		name:      "t",
+		batchSize: 2,
+		header:    &fakeHeader{num: 100},
+		getHeaders: func(from types.IHeader) ([]types.IHeader, error) {
+			if from.NumberU64() == 0 {
+				return newPagedHeaders(0, 2), nil
+			}
+			return nil, wantErr
+		},
+		getBlocks: func(hashes []common.Hash) ([]types.IBlock, error) {
+			blocks := make([]types.IBlock, len(hashes))
+			for i, h := range hashes {
+				blocks[i] = &fakeBlock{num: hashToNum(h)}
+			}
+			return blocks, nil
+		},
+	}
+
+	bc := &fakeBlockchain{current: &fakeHeader{num: 0}}
+	err := t1.runPipeline(bc, &fakeHeader{num: 0}, nil, log.New())
+	if !errors.Is(err, wantErr) {
+		t.Fatalf("expected runPipeline to return the header-fetch error, got %v", err)
+	}
+}
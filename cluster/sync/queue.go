@@ -0,0 +1,273 @@
+package sync
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/QuarkChain/goquarkchain/core/types"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/log"
+)
+
+// skeletonStride is the spacing, in block numbers, between the headers
+// fetched to build the skeleton of the target chain. Everything in between
+// two skeleton headers is filled in by whichever peer is assigned that
+// sub-range.
+const skeletonStride = 192
+
+// queue fans a header/body download out across every peer in a PeerPool: a
+// skeleton of the target chain is pinned down from the best peer, then the
+// gaps between skeleton headers are split across the rest by throughput.
+type queue struct {
+	pool      PeerPool
+	batchSize int
+}
+
+func newQueue(pool PeerPool, batchSize int) *queue {
+	return &queue{pool: pool, batchSize: batchSize}
+}
+
+// segment is a contiguous run of headers assigned to one peer.
+type segment struct {
+	headers []types.IHeader
+	index   int // position of this segment in the overall download
+}
+
+// fetchSkeleton retrieves every skeletonStride'th header between ancestor
+// (exclusive) and the pool's best peer's head.
+func (q *queue) fetchSkeleton(ancestor types.IHeader) ([]types.IHeader, error) {
+	best := q.pool.BestPeer()
+	if best == nil {
+		return nil, fmt.Errorf("statesync queue: no peers available")
+	}
+	_, headNum := best.Head()
+	if headNum <= ancestor.NumberU64() {
+		return nil, nil
+	}
+	amount := int((headNum-ancestor.NumberU64())/skeletonStride) + 1
+	skeleton, err := best.GetHeaders(ancestor, amount, skeletonStride-1, false)
+	if err != nil {
+		return nil, fmt.Errorf("fetching skeleton from %s: %w", best.ID(), err)
+	}
+	return skeleton, nil
+}
+
+// fill downloads every header between consecutive skeleton entries plus the
+// stretch from the last skeleton entry up to the peer pool's actual head,
+// distributing the gaps across all idle peers and reassembling the results
+// in order. fallback is the task's normal single-peer header fetcher and is
+// used instead when no additional peers are registered.
+func (q *queue) fill(skeleton []types.IHeader, ancestor types.IHeader, fallback func(types.IHeader) ([]types.IHeader, error)) ([]types.IHeader, error) {
+	peers := q.pool.Peers()
+	if len(peers) <= 1 || len(skeleton) == 0 {
+		return fallback(ancestor)
+	}
+
+	// Build the list of gaps: (from, to] pairs bounded by skeleton headers,
+	// plus a final gap from the last skeleton header up to the current head
+	// so the newest stretch isn't left for the next round's fallback.
+	from := ancestor
+	gaps := make([]types.IHeader, 0, len(skeleton)+1)
+	amounts := make([]int, 0, len(skeleton)+1)
+	for _, h := range skeleton {
+		gaps = append(gaps, from)
+		amounts = append(amounts, skeletonStride)
+		from = h
+	}
+	if best := q.pool.BestPeer(); best != nil {
+		if _, headNum := best.Head(); headNum > from.NumberU64() {
+			gaps = append(gaps, from)
+			amounts = append(amounts, int(headNum-from.NumberU64()))
+		}
+	}
+
+	results := make([]segment, len(gaps))
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		firstErr error
+	)
+	work := make(chan int, len(gaps))
+	for i := range gaps {
+		work <- i
+	}
+	close(work)
+
+	assign := func(peer Peer) {
+		defer wg.Done()
+		for idx := range work {
+			headers, err := peer.GetHeaders(gaps[idx], amounts[idx], 0, false)
+			if err != nil {
+				log.Warn("sync queue: peer failed to serve gap, retrying on another peer", "peer", peer.ID(), "gap", idx, "err", err)
+				q.retry(idx, gaps, amounts, results, peer.ID(), &mu, &firstErr)
+				continue
+			}
+			mu.Lock()
+			results[idx] = segment{headers: headers, index: idx}
+			mu.Unlock()
+		}
+	}
+
+	sort.Slice(peers, func(i, j int) bool { return peers[i].Throughput() > peers[j].Throughput() })
+	for _, p := range peers {
+		wg.Add(1)
+		go assign(p)
+	}
+	wg.Wait()
+
+	if firstErr != nil {
+		return nil, firstErr
+	}
+
+	var merged []types.IHeader
+	for _, seg := range results {
+		merged = append(merged, seg.headers...)
+	}
+	return merged, nil
+}
+
+// retry re-queues a failed gap onto the fastest peer that hasn't already
+// failed it this round, trying the next-fastest remaining peer each time one
+// fails, until it succeeds or every peer has been tried.
+func (q *queue) retry(idx int, gaps []types.IHeader, amounts []int, results []segment, failed string, mu *sync.Mutex, firstErr *error) {
+	excluded := map[string]bool{failed: true}
+	for {
+		peer := q.nextPeer(excluded)
+		if peer == nil {
+			mu.Lock()
+			if *firstErr == nil {
+				*firstErr = fmt.Errorf("sync queue: no peers left to retry gap %d", idx)
+			}
+			mu.Unlock()
+			return
+		}
+		headers, err := peer.GetHeaders(gaps[idx], amounts[idx], 0, false)
+		if err != nil {
+			log.Warn("sync queue: retry peer also failed to serve gap, trying another", "peer", peer.ID(), "gap", idx, "err", err)
+			excluded[peer.ID()] = true
+			continue
+		}
+		mu.Lock()
+		results[idx] = segment{headers: headers, index: idx}
+		mu.Unlock()
+		return
+	}
+}
+
+// nextPeer returns the fastest peer in the pool not in excluded, or nil if
+// none remain.
+func (q *queue) nextPeer(excluded map[string]bool) Peer {
+	peers := q.pool.Peers()
+	sort.Slice(peers, func(i, j int) bool { return peers[i].Throughput() > peers[j].Throughput() })
+	for _, p := range peers {
+		if !excluded[p.ID()] {
+			return p
+		}
+	}
+	return nil
+}
+
+// fetchBlocks downloads bodies for hashes across every peer in the pool,
+// splitting the list into batches and handing them out through a work
+// queue so a peer that finishes early picks up another batch, and so a
+// failed batch is re-queued onto another peer instead of aborting the
+// whole call.
+func (q *queue) fetchBlocks(hashes []common.Hash) ([]types.IBlock, error) {
+	peers := q.pool.Peers()
+	if len(peers) <= 1 {
+		return nil, fmt.Errorf("sync queue: fetchBlocks requires at least 2 peers")
+	}
+
+	chunks, offsets := chunkHashes(hashes, len(peers))
+	blocks := make([]types.IBlock, len(hashes))
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		firstErr error
+	)
+	work := make(chan int, len(chunks))
+	for i := range chunks {
+		work <- i
+	}
+	close(work)
+
+	assign := func(peer Peer) {
+		defer wg.Done()
+		for idx := range work {
+			got, err := peer.GetBlocks(chunks[idx])
+			if err != nil {
+				log.Warn("sync queue: peer failed to serve block batch, retrying on another peer", "peer", peer.ID(), "batch", idx, "err", err)
+				q.retryBlocks(idx, chunks, offsets, blocks, peer.ID(), &mu, &firstErr)
+				continue
+			}
+			mu.Lock()
+			for i, b := range got {
+				blocks[offsets[idx]+i] = b
+			}
+			mu.Unlock()
+		}
+	}
+
+	sort.Slice(peers, func(i, j int) bool { return peers[i].Throughput() > peers[j].Throughput() })
+	for _, p := range peers {
+		wg.Add(1)
+		go assign(p)
+	}
+	wg.Wait()
+
+	if firstErr != nil {
+		return nil, firstErr
+	}
+	return blocks, nil
+}
+
+// retryBlocks re-queues a failed block batch onto the fastest peer that
+// hasn't already failed it this round, same as retry but for block bodies.
+func (q *queue) retryBlocks(idx int, chunks [][]common.Hash, offsets []int, blocks []types.IBlock, failed string, mu *sync.Mutex, firstErr *error) {
+	excluded := map[string]bool{failed: true}
+	for {
+		peer := q.nextPeer(excluded)
+		if peer == nil {
+			mu.Lock()
+			if *firstErr == nil {
+				*firstErr = fmt.Errorf("sync queue: no peers left to retry block batch %d", idx)
+			}
+			mu.Unlock()
+			return
+		}
+		got, err := peer.GetBlocks(chunks[idx])
+		if err != nil {
+			log.Warn("sync queue: retry peer also failed to serve block batch, trying another", "peer", peer.ID(), "batch", idx, "err", err)
+			excluded[peer.ID()] = true
+			continue
+		}
+		mu.Lock()
+		for i, b := range got {
+			blocks[offsets[idx]+i] = b
+		}
+		mu.Unlock()
+		return
+	}
+}
+
+// chunkHashes splits hashes into n roughly-equal contiguous batches, plus
+// the offset each batch starts at in the original list, so a batch's result
+// can be written back to the right place regardless of retries.
+func chunkHashes(hashes []common.Hash, n int) ([][]common.Hash, []int) {
+	size := (len(hashes) + n - 1) / n
+	if size == 0 {
+		size = 1
+	}
+	var chunks [][]common.Hash
+	var offsets []int
+	for offset := 0; offset < len(hashes); offset += size {
+		end := offset + size
+		if end > len(hashes) {
+			end = len(hashes)
+		}
+		chunks = append(chunks, hashes[offset:end])
+		offsets = append(offsets, offset)
+	}
+	return chunks, offsets
+}
@@ -0,0 +1,249 @@
+package sync
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math/big"
+	"sync"
+	"testing"
+
+	"github.com/QuarkChain/goquarkchain/core/types"
+	"github.com/ethereum/go-ethereum/common"
+)
+
+type fakeHeader struct {
+	num       uint64
+	variant   byte // distinguishes headers that share a height but not a hash
+	stateRoot common.Hash
+}
+
+func (h *fakeHeader) NumberU64() uint64 { return h.num }
+
+func (h *fakeHeader) Hash() common.Hash {
+	var buf [9]byte
+	binary.BigEndian.PutUint64(buf[:8], h.num)
+	buf[8] = h.variant
+	return common.BytesToHash(buf[:])
+}
+
+// GetParentHash links each fake header to the variant-0 header one below it,
+// so consecutive runs from newPagedHeaders pass validateHeaderList.
+func (h *fakeHeader) GetParentHash() common.Hash {
+	if h.num == 0 {
+		return common.Hash{}
+	}
+	return (&fakeHeader{num: h.num - 1}).Hash()
+}
+func (h *fakeHeader) GetStateRoot() common.Hash  { return h.stateRoot }
+func (h *fakeHeader) GetDifficulty() *big.Int    { return nil }
+
+type fakeQueuePeer struct {
+	id         string
+	head       uint64
+	throughput float64
+	failAlways bool // GetHeaders/GetBlocks always return an error
+
+	mu    sync.Mutex
+	calls []fakeCall
+}
+
+type fakeCall struct {
+	origin uint64
+	amount int
+}
+
+func (p *fakeQueuePeer) ID() string { return p.id }
+
+func (p *fakeQueuePeer) Head() (common.Hash, uint64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return common.Hash{}, p.head
+}
+
+// SetHead updates the head height this peer advertises, safe to call
+// concurrently with Head() from another goroutine.
+func (p *fakeQueuePeer) SetHead(num uint64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.head = num
+}
+
+func (p *fakeQueuePeer) Throughput() float64 { return p.throughput }
+
+func (p *fakeQueuePeer) GetBlocks(hashes []common.Hash) ([]types.IBlock, error) {
+	if p.failAlways {
+		return nil, fmt.Errorf("fakeQueuePeer %s: forced GetBlocks failure", p.id)
+	}
+	blocks := make([]types.IBlock, len(hashes))
+	for i := range hashes {
+		blocks[i] = &fakeBlock{num: uint64(i)}
+	}
+	return blocks, nil
+}
+
+func (p *fakeQueuePeer) GetHeaders(origin types.IHeader, amount, skip int, reverse bool) ([]types.IHeader, error) {
+	p.mu.Lock()
+	p.calls = append(p.calls, fakeCall{origin: origin.NumberU64(), amount: amount})
+	p.mu.Unlock()
+
+	if p.failAlways {
+		return nil, fmt.Errorf("fakeQueuePeer %s: forced GetHeaders failure", p.id)
+	}
+
+	headers := make([]types.IHeader, 0, amount)
+	for i := 1; i <= amount; i++ {
+		n := origin.NumberU64() + uint64(i)
+		if n > p.head {
+			break
+		}
+		headers = append(headers, &fakeHeader{num: n})
+	}
+	return headers, nil
+}
+
+type fakeQueuePool struct {
+	peers []*fakeQueuePeer
+}
+
+func (p *fakeQueuePool) Peer(id string) Peer {
+	for _, peer := range p.peers {
+		if peer.id == id {
+			return peer
+		}
+	}
+	return nil
+}
+
+func (p *fakeQueuePool) Peers() []Peer {
+	out := make([]Peer, len(p.peers))
+	for i, peer := range p.peers {
+		out[i] = peer
+	}
+	return out
+}
+
+func (p *fakeQueuePool) BestPeer() Peer {
+	var best *fakeQueuePeer
+	var bestNum uint64
+	for _, peer := range p.peers {
+		if _, num := peer.Head(); best == nil || num > bestNum {
+			best, bestNum = peer, num
+		}
+	}
+	if best == nil {
+		return nil
+	}
+	return best
+}
+
+func TestQueueFillCoversFinalStretchPastLastSkeletonHeader(t *testing.T) {
+	peerA := &fakeQueuePeer{id: "a", head: 500, throughput: 10}
+	peerB := &fakeQueuePeer{id: "b", head: 500, throughput: 5}
+	pool := &fakeQueuePool{peers: []*fakeQueuePeer{peerA, peerB}}
+	q := newQueue(pool, 0)
+
+	ancestor := &fakeHeader{num: 0}
+	skeleton := []types.IHeader{&fakeHeader{num: skeletonStride}}
+
+	fallbackCalled := false
+	fallback := func(types.IHeader) ([]types.IHeader, error) {
+		fallbackCalled = true
+		return nil, nil
+	}
+
+	headers, err := q.fill(skeleton, ancestor, fallback)
+	if err != nil {
+		t.Fatalf("fill: %v", err)
+	}
+	if fallbackCalled {
+		t.Fatalf("fallback should not be used with 2 peers registered")
+	}
+
+	last := headers[len(headers)-1]
+	if last.NumberU64() != 500 {
+		t.Fatalf("expected fill to cover up to the peer head 500, got last header %d", last.NumberU64())
+	}
+
+	var sawFinalGap bool
+	for _, peer := range pool.peers {
+		peer.mu.Lock()
+		for _, c := range peer.calls {
+			if c.origin == skeletonStride {
+				sawFinalGap = true
+			}
+		}
+		peer.mu.Unlock()
+	}
+	if !sawFinalGap {
+		t.Fatalf("expected a gap fetch starting at the last skeleton header %d", skeletonStride)
+	}
+}
+
+func TestQueueFillUsesFallbackWithOnePeer(t *testing.T) {
+	peerA := &fakeQueuePeer{id: "a", head: 500, throughput: 10}
+	pool := &fakeQueuePool{peers: []*fakeQueuePeer{peerA}}
+	q := newQueue(pool, 0)
+
+	ancestor := &fakeHeader{num: 0}
+	skeleton := []types.IHeader{&fakeHeader{num: skeletonStride}}
+
+	called := false
+	fallback := func(h types.IHeader) ([]types.IHeader, error) {
+		called = true
+		if h.NumberU64() != ancestor.NumberU64() {
+			return nil, fmt.Errorf("unexpected fallback origin %d", h.NumberU64())
+		}
+		return nil, nil
+	}
+
+	if _, err := q.fill(skeleton, ancestor, fallback); err != nil {
+		t.Fatalf("fill: %v", err)
+	}
+	if !called {
+		t.Fatalf("expected fallback to be used with a single peer")
+	}
+}
+
+func TestQueueFillRetriesOnAnotherPeerAfterFailure(t *testing.T) {
+	peerA := &fakeQueuePeer{id: "a", head: 500, throughput: 10, failAlways: true}
+	peerB := &fakeQueuePeer{id: "b", head: 500, throughput: 5}
+	pool := &fakeQueuePool{peers: []*fakeQueuePeer{peerA, peerB}}
+	q := newQueue(pool, 0)
+
+	ancestor := &fakeHeader{num: 0}
+	skeleton := []types.IHeader{&fakeHeader{num: skeletonStride}}
+
+	headers, err := q.fill(skeleton, ancestor, func(types.IHeader) ([]types.IHeader, error) {
+		t.Fatalf("fallback should not be reached when a healthy peer remains")
+		return nil, nil
+	})
+	if err != nil {
+		t.Fatalf("fill: %v, want the gaps peerA failed to be served by peerB instead", err)
+	}
+	last := headers[len(headers)-1]
+	if last.NumberU64() != 500 {
+		t.Fatalf("expected fill to cover up to the peer head 500 despite peerA's failures, got last header %d", last.NumberU64())
+	}
+}
+
+func TestQueueFetchBlocksRetriesFailedBatchOnAnotherPeer(t *testing.T) {
+	peerA := &fakeQueuePeer{id: "a", head: 500, throughput: 10, failAlways: true}
+	peerB := &fakeQueuePeer{id: "b", head: 500, throughput: 5}
+	pool := &fakeQueuePool{peers: []*fakeQueuePeer{peerA, peerB}}
+	q := newQueue(pool, 0)
+
+	hashes := make([]common.Hash, 8)
+	for i := range hashes {
+		hashes[i] = common.BytesToHash([]byte{byte(i + 1)})
+	}
+
+	blocks, err := q.fetchBlocks(hashes)
+	if err != nil {
+		t.Fatalf("fetchBlocks: %v, want peerA's failed batches to be served by peerB instead", err)
+	}
+	for i, b := range blocks {
+		if b == nil {
+			t.Fatalf("expected every hash to have a block after redistribution, hash %d is missing", i)
+		}
+	}
+}
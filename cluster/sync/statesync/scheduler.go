@@ -0,0 +1,343 @@
+// Package statesync fetches a full state trie (accounts, contract storage,
+// and contract code) by scheduling trie-node requests across a set of
+// peers, used by the fast-sync task.
+package statesync
+
+import (
+	"errors"
+	"math/big"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/log"
+	"github.com/ethereum/go-ethereum/rlp"
+)
+
+// ErrCancelled is returned by Run when the scheduler is stopped before the
+// trie has been fully retrieved.
+var ErrCancelled = errors.New("statesync: cancelled")
+
+const (
+	maxOutstandingPerPeer = 128
+	requestTimeout        = 8 * time.Second
+	maxRetries            = 5
+)
+
+// Peer is the minimal capability the scheduler needs from a connected node.
+type Peer interface {
+	ID() string
+	RequestNodeData(hashes []common.Hash) error
+}
+
+// Database is the subset of the state database the scheduler writes
+// retrieved trie nodes and contract code into.
+type Database interface {
+	Put(key, value []byte) error
+}
+
+// request tracks a single outstanding trie-node fetch.
+type request struct {
+	hash    common.Hash
+	peer    string
+	sent    time.Time
+	retries int
+}
+
+// Scheduler drives a full state-trie download rooted at a single state root.
+type Scheduler struct {
+	db   Database
+	lock sync.Mutex
+
+	queue     []common.Hash          // hashes not yet requested from any peer
+	pending   map[common.Hash]*request // hashes currently in flight
+	done      map[common.Hash]bool    // hashes already retrieved and committed
+	inflight  map[string]int          // per-peer count of outstanding requests
+
+	peersMu sync.RWMutex
+	peers   map[string]Peer
+
+	quit chan struct{}
+	once sync.Once
+}
+
+// NewScheduler creates a scheduler for the trie rooted at root and seeds its
+// work queue with that single hash.
+func NewScheduler(root common.Hash, db Database) *Scheduler {
+	s := &Scheduler{
+		db:       db,
+		pending:  make(map[common.Hash]*request),
+		done:     make(map[common.Hash]bool),
+		inflight: make(map[string]int),
+		peers:    make(map[string]Peer),
+		quit:     make(chan struct{}),
+	}
+	if root != (common.Hash{}) {
+		s.queue = append(s.queue, root)
+	}
+	return s
+}
+
+// RegisterPeer adds a peer the scheduler may dispatch requests to.
+func (s *Scheduler) RegisterPeer(p Peer) {
+	s.peersMu.Lock()
+	defer s.peersMu.Unlock()
+	s.peers[p.ID()] = p
+}
+
+// UnregisterPeer removes a peer, re-queueing anything it still owed us.
+func (s *Scheduler) UnregisterPeer(id string) {
+	s.peersMu.Lock()
+	delete(s.peers, id)
+	s.peersMu.Unlock()
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for hash, req := range s.pending {
+		if req.peer == id {
+			delete(s.pending, hash)
+			s.queue = append(s.queue, hash)
+		}
+	}
+	delete(s.inflight, id)
+}
+
+// Pending reports whether the trie has any outstanding or queued work left.
+func (s *Scheduler) Pending() bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return len(s.queue) > 0 || len(s.pending) > 0
+}
+
+// Run dispatches outstanding requests to idle peers and blocks until the
+// whole trie has been retrieved or the scheduler is stopped.
+func (s *Scheduler) Run() error {
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+
+	for {
+		if !s.Pending() {
+			return nil
+		}
+		select {
+		case <-s.quit:
+			return ErrCancelled
+		case <-ticker.C:
+			s.assign()
+			s.reapTimeouts()
+		}
+	}
+}
+
+// Stop cancels a running scheduler.
+func (s *Scheduler) Stop() {
+	s.once.Do(func() { close(s.quit) })
+}
+
+// assign hands out queued hashes to peers below their outstanding limit.
+func (s *Scheduler) assign() {
+	s.lock.Lock()
+	if len(s.queue) == 0 {
+		s.lock.Unlock()
+		return
+	}
+	s.lock.Unlock()
+
+	s.peersMu.RLock()
+	candidates := make([]Peer, 0, len(s.peers))
+	for _, p := range s.peers {
+		candidates = append(candidates, p)
+	}
+	s.peersMu.RUnlock()
+
+	for _, p := range candidates {
+		batch := s.takeBatch(p.ID())
+		if len(batch) == 0 {
+			continue
+		}
+		if err := p.RequestNodeData(batch); err != nil {
+			log.Debug("statesync: request failed, requeueing", "peer", p.ID(), "err", err)
+			s.requeue(p.ID(), batch)
+		}
+	}
+}
+
+func (s *Scheduler) takeBatch(peerID string) []common.Hash {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	room := maxOutstandingPerPeer - s.inflight[peerID]
+	if room <= 0 || len(s.queue) == 0 {
+		return nil
+	}
+	if room > len(s.queue) {
+		room = len(s.queue)
+	}
+
+	batch := s.queue[:room]
+	s.queue = s.queue[room:]
+
+	now := time.Now()
+	for _, hash := range batch {
+		s.pending[hash] = &request{hash: hash, peer: peerID, sent: now}
+	}
+	s.inflight[peerID] += len(batch)
+	return batch
+}
+
+func (s *Scheduler) requeue(peerID string, hashes []common.Hash) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for _, hash := range hashes {
+		delete(s.pending, hash)
+		s.queue = append(s.queue, hash)
+	}
+	s.inflight[peerID] -= len(hashes)
+}
+
+// reapTimeouts puts hashes whose peer never answered back on the queue.
+func (s *Scheduler) reapTimeouts() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	now := time.Now()
+	for hash, req := range s.pending {
+		if now.Sub(req.sent) < requestTimeout {
+			continue
+		}
+		delete(s.pending, hash)
+		s.inflight[req.peer]--
+		if req.retries+1 > maxRetries {
+			log.Warn("statesync: node exceeded retry limit, dropping", "hash", hash, "retries", req.retries)
+			continue
+		}
+		s.queue = append(s.queue, hash)
+	}
+}
+
+// Deliver matches each returned blob's hash against an outstanding request
+// and, once verified, commits it and queues any child references it finds.
+// Blobs matching no request outstanding to peerID are ignored; a matched blob
+// that does not decode as a trie node (e.g. contract code) is still
+// committed and counted, with no children queued.
+func (s *Scheduler) Deliver(peerID string, blobs [][]byte) (int, error) {
+	accepted := 0
+	for _, blob := range blobs {
+		hash := crypto.Keccak256Hash(blob)
+
+		s.lock.Lock()
+		req, ok := s.pending[hash]
+		if !ok || req.peer != peerID {
+			s.lock.Unlock()
+			continue
+		}
+		delete(s.pending, hash)
+		s.inflight[peerID]--
+		s.done[hash] = true
+		s.lock.Unlock()
+
+		if err := s.db.Put(hash.Bytes(), blob); err != nil {
+			return accepted, err
+		}
+
+		children, err := childReferences(blob)
+		if err != nil {
+			log.Warn("statesync: failed to decode trie node, skipping children", "hash", hash, "err", err)
+			accepted++
+			continue
+		}
+
+		s.lock.Lock()
+		for _, child := range children {
+			if !s.done[child] {
+				if _, inflight := s.pending[child]; !inflight {
+					s.queue = append(s.queue, child)
+				}
+			}
+		}
+		s.lock.Unlock()
+
+		accepted++
+	}
+	return accepted, nil
+}
+
+// account mirrors the RLP shape of a state-trie leaf value: [nonce, balance,
+// storageRoot, codeHash].
+type account struct {
+	Nonce    uint64
+	Balance  *big.Int
+	Root     common.Hash
+	CodeHash []byte
+}
+
+// emptyRoot and emptyCodeHash are the well-known values an account without
+// storage or code carries; they're skipped since there's nothing to fetch.
+var (
+	emptyRoot     = crypto.Keccak256Hash([]byte{0x80})
+	emptyCodeHash = crypto.Keccak256Hash(nil)
+)
+
+// childReferences walks one decoded trie node (a 2-item "short" node or a
+// 17-item "full" node, per the Merkle-Patricia trie encoding) and returns the
+// hashes of every child it references. This includes direct trie-node
+// children, children embedded inline in the node instead of hash-referenced
+// (the standard MPT optimization for sub-nodes whose RLP encoding is under
+// 32 bytes), and, when a leaf's value decodes as an account, that account's
+// storage-trie root and contract code hash.
+func childReferences(blob []byte) ([]common.Hash, error) {
+	var raw []rlp.RawValue
+	if err := rlp.DecodeBytes(blob, &raw); err != nil {
+		// Leaf values and contract code are not RLP lists of children.
+		return nil, nil
+	}
+	return nodeChildren(raw), nil
+}
+
+// nodeChildren is childReferences' recursive step: a branch or extension
+// node's items are themselves either hash references, embedded sub-nodes, or
+// (for a leaf) an account value, and an embedded sub-node's own children must
+// be found by recursing into it rather than fetching it, since its bytes are
+// already present in the parent blob.
+func nodeChildren(raw []rlp.RawValue) []common.Hash {
+	var children []common.Hash
+	for _, item := range raw {
+		if len(item) == 0 {
+			continue
+		}
+		if len(item) == common.HashLength+1 { // RLP-encoded 32-byte hash
+			var hash common.Hash
+			if err := rlp.DecodeBytes(item, &hash); err == nil {
+				children = append(children, hash)
+			}
+			continue
+		}
+		if item[0] >= 0xc0 { // RLP list prefix: an embedded sub-node, not a hash
+			var sub []rlp.RawValue
+			if rlp.DecodeBytes(item, &sub) == nil {
+				children = append(children, nodeChildren(sub)...)
+			}
+			continue
+		}
+
+		// A leaf's value is itself RLP-encoded as an opaque byte string, so it
+		// takes one decode to unwrap that string and a second to interpret
+		// its content as an account.
+		var valueBytes []byte
+		if rlp.DecodeBytes(item, &valueBytes) != nil {
+			continue
+		}
+		var acc account
+		if rlp.DecodeBytes(valueBytes, &acc) != nil {
+			continue
+		}
+		if acc.Root != (common.Hash{}) && acc.Root != emptyRoot {
+			children = append(children, acc.Root)
+		}
+		if codeHash := common.BytesToHash(acc.CodeHash); codeHash != (common.Hash{}) && codeHash != emptyCodeHash {
+			children = append(children, codeHash)
+		}
+	}
+	return children
+}
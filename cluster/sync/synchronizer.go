@@ -0,0 +1,199 @@
+package sync
+
+import (
+	"container/heap"
+	"fmt"
+	"sync"
+
+	"github.com/QuarkChain/goquarkchain/core/types"
+	"github.com/ethereum/go-ethereum/log"
+)
+
+// Synchronizer tracks every peer currently available for syncing and runs
+// the queue of pending sync Tasks against them, highest priority first.
+type Synchronizer struct {
+	mu    sync.RWMutex
+	peers map[string]Peer
+
+	taskMu sync.Mutex
+	tasks  taskHeap
+
+	beaconMu          sync.Mutex
+	trustedHead       types.IHeader
+	beaconTaskFactory func(types.IHeader) Task
+}
+
+// NewSynchronizer creates an empty Synchronizer with no peers or tasks.
+func NewSynchronizer() *Synchronizer {
+	s := &Synchronizer{peers: make(map[string]Peer)}
+	heap.Init(&s.tasks)
+	return s
+}
+
+// SetBeaconTaskFactory supplies the constructor SetTrustedHead uses to turn a
+// newly-trusted header into a BeaconTask, e.g. NewBeaconTask bound to this
+// shard/root chain's findAncestor/getHeaders/getBlocks/syncBlock callbacks.
+func (s *Synchronizer) SetBeaconTaskFactory(f func(types.IHeader) Task) {
+	s.beaconMu.Lock()
+	defer s.beaconMu.Unlock()
+	s.beaconTaskFactory = f
+}
+
+// SetTrustedHead pins header as the trusted sync target, refusing to move it
+// backwards, and queues a BeaconTask for it via the configured
+// BeaconTaskFactory. It underlies the JSON-RPC method sync_setTrustedHead.
+func (s *Synchronizer) SetTrustedHead(header types.IHeader) error {
+	if header == nil {
+		return fmt.Errorf("sync_setTrustedHead: header must not be nil")
+	}
+
+	s.beaconMu.Lock()
+	if s.trustedHead != nil && header.NumberU64() < s.trustedHead.NumberU64() {
+		num := s.trustedHead.NumberU64()
+		s.beaconMu.Unlock()
+		return fmt.Errorf("sync_setTrustedHead: refusing to move trusted head backwards from %d to %d", num, header.NumberU64())
+	}
+	s.trustedHead = header
+	factory := s.beaconTaskFactory
+	s.beaconMu.Unlock()
+
+	if factory == nil {
+		return fmt.Errorf("sync_setTrustedHead: no BeaconTaskFactory configured")
+	}
+	s.AddTask(factory(header))
+	return nil
+}
+
+// TrustedHead returns the currently pinned trusted target, or nil if none
+// has been set.
+func (s *Synchronizer) TrustedHead() types.IHeader {
+	s.beaconMu.Lock()
+	defer s.beaconMu.Unlock()
+	return s.trustedHead
+}
+
+// RegisterPeer adds a peer that tasks may pull work from, beyond whichever
+// peer they were originally created against.
+func (s *Synchronizer) RegisterPeer(p Peer) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.peers[p.ID()] = p
+}
+
+// UnregisterPeer removes a peer, e.g. on disconnect.
+func (s *Synchronizer) UnregisterPeer(id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.peers, id)
+}
+
+// Peer implements PeerPool.
+func (s *Synchronizer) Peer(id string) Peer {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.peers[id]
+}
+
+// Peers implements PeerPool.
+func (s *Synchronizer) Peers() []Peer {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	peers := make([]Peer, 0, len(s.peers))
+	for _, p := range s.peers {
+		peers = append(peers, p)
+	}
+	return peers
+}
+
+// BestPeer implements PeerPool, returning the peer advertising the tallest
+// head, or nil if no peers are registered.
+func (s *Synchronizer) BestPeer() Peer {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var best Peer
+	var bestNum uint64
+	for _, p := range s.peers {
+		if _, num := p.Head(); best == nil || num > bestNum {
+			best, bestNum = p, num
+		}
+	}
+	return best
+}
+
+// AddTask queues a sync Task, ordered against every other pending task by
+// Priority(), and gives it access to the full peer pool. A task targeting a
+// header that's already queued is dropped rather than duplicated. So is any
+// ordinary task targeting at or below the pinned trusted head: BeaconTask's
+// priority ordering only makes it run first, it doesn't stop a later
+// ordinary task for a rival fork from being queued and run once it's done,
+// so that has to be enforced here instead.
+func (s *Synchronizer) AddTask(t Task) {
+	s.taskMu.Lock()
+	defer s.taskMu.Unlock()
+
+	trustedTask, _ := t.(trustedTargetTask)
+	if trustedTask == nil || !trustedTask.trustedTarget() {
+		if trusted := s.TrustedHead(); trusted != nil && t.TargetHeader().NumberU64() <= trusted.NumberU64() {
+			log.Warn("synchronizer: dropping task conflicting with trusted head", "peer", t.PeerID(), "target", t.TargetHeader().NumberU64(), "trusted", trusted.NumberU64())
+			return
+		}
+	}
+
+	target := t.TargetHeader().Hash()
+	for _, queued := range s.tasks {
+		if queued.TargetHeader().Hash() == target {
+			return
+		}
+	}
+
+	t.SetPeerPool(s)
+	heap.Push(&s.tasks, t)
+}
+
+// NextTask pops the highest-priority pending task, or nil if none are
+// queued.
+func (s *Synchronizer) NextTask() Task {
+	s.taskMu.Lock()
+	defer s.taskMu.Unlock()
+	if s.tasks.Len() == 0 {
+		return nil
+	}
+	return heap.Pop(&s.tasks).(Task)
+}
+
+// RunOne pops and executes the highest-priority pending task against bc, if
+// any is queued.
+func (s *Synchronizer) RunOne(bc blockchain) error {
+	t := s.NextTask()
+	if t == nil {
+		return nil
+	}
+	if err := t.Run(bc); err != nil {
+		log.Error("synchronizer: task failed", "peer", t.PeerID(), "err", err)
+		return err
+	}
+	return nil
+}
+
+// taskHeap orders Tasks by descending Priority() so the synchronizer always
+// works on the most valuable chain first.
+type taskHeap []Task
+
+func (h taskHeap) Len() int { return len(h) }
+func (h taskHeap) Less(i, j int) bool {
+	return h[i].Priority().Cmp(h[j].Priority()) > 0
+}
+func (h taskHeap) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+
+func (h *taskHeap) Push(x interface{}) {
+	*h = append(*h, x.(Task))
+}
+
+func (h *taskHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	t := old[n-1]
+	*h = old[:n-1]
+	return t
+}
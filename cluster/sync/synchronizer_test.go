@@ -0,0 +1,155 @@
+package sync
+
+import (
+	"math/big"
+	"testing"
+
+	"github.com/QuarkChain/goquarkchain/core/types"
+)
+
+type fakeTask struct {
+	peerID string
+	header *fakeHeader
+	diff   int64
+	pool   PeerPool
+	beacon bool // stands in for *BeaconTask against AddTask's trusted-head check
+}
+
+func (t *fakeTask) SetSendFunc(func(value interface{}) int) {}
+func (t *fakeTask) SetPeerPool(pool PeerPool)                   { t.pool = pool }
+func (t *fakeTask) Run(blockchain) error                        { return nil }
+func (t *fakeTask) PeerID() string                              { return t.peerID }
+func (t *fakeTask) TargetHeader() types.IHeader                 { return t.header }
+func (t *fakeTask) trustedTarget() bool                         { return t.beacon }
+
+func (t *fakeTask) Priority() *big.Int {
+	height := new(big.Int).SetUint64(t.header.NumberU64())
+	height.Lsh(height, priorityHeightBits)
+	return height.Or(height, big.NewInt(t.diff))
+}
+
+func TestSynchronizerRunsHighestHeightFirst(t *testing.T) {
+	s := NewSynchronizer()
+	low := &fakeTask{peerID: "low", header: &fakeHeader{num: 10}, diff: 1000}
+	high := &fakeTask{peerID: "high", header: &fakeHeader{num: 20}, diff: 1}
+
+	s.AddTask(low)
+	s.AddTask(high)
+
+	first := s.NextTask()
+	if first.PeerID() != "high" {
+		t.Fatalf("expected the higher-height task to run first regardless of difficulty, got %q", first.PeerID())
+	}
+	second := s.NextTask()
+	if second.PeerID() != "low" {
+		t.Fatalf("expected the lower-height task second, got %q", second.PeerID())
+	}
+}
+
+func TestSynchronizerBreaksTiesByDifficulty(t *testing.T) {
+	s := NewSynchronizer()
+	weak := &fakeTask{peerID: "weak", header: &fakeHeader{num: 10, variant: 1}, diff: 5}
+	strong := &fakeTask{peerID: "strong", header: &fakeHeader{num: 10, variant: 2}, diff: 50}
+
+	s.AddTask(weak)
+	s.AddTask(strong)
+
+	first := s.NextTask()
+	if first.PeerID() != "strong" {
+		t.Fatalf("expected the strong task to win priority ordering at equal height, got %q", first.PeerID())
+	}
+}
+
+func TestSynchronizerAddTaskDropsDuplicateTarget(t *testing.T) {
+	s := NewSynchronizer()
+	header := &fakeHeader{num: 42}
+	first := &fakeTask{peerID: "a", header: header}
+	second := &fakeTask{peerID: "b", header: header}
+
+	s.AddTask(first)
+	s.AddTask(second)
+
+	if got := s.tasks.Len(); got != 1 {
+		t.Fatalf("expected duplicate target to be dropped, queue has %d tasks", got)
+	}
+	if s.NextTask().PeerID() != "a" {
+		t.Fatalf("expected the first-queued task to be kept")
+	}
+}
+
+func TestSynchronizerNextTaskEmpty(t *testing.T) {
+	s := NewSynchronizer()
+	if s.NextTask() != nil {
+		t.Fatalf("expected nil from an empty queue")
+	}
+}
+
+func TestSynchronizerSetTrustedHeadQueuesBeaconTask(t *testing.T) {
+	s := NewSynchronizer()
+	var built types.IHeader
+	s.SetBeaconTaskFactory(func(header types.IHeader) Task {
+		built = header
+		return &fakeTask{peerID: "beacon", header: &fakeHeader{num: header.NumberU64()}, beacon: true}
+	})
+
+	header := &fakeHeader{num: 100}
+	if err := s.SetTrustedHead(header); err != nil {
+		t.Fatalf("SetTrustedHead: %v", err)
+	}
+	if built != header {
+		t.Fatalf("expected the factory to receive the trusted header")
+	}
+	if s.TrustedHead() != header {
+		t.Fatalf("expected TrustedHead to report the pinned header")
+	}
+	if got := s.NextTask(); got == nil || got.PeerID() != "beacon" {
+		t.Fatalf("expected SetTrustedHead to queue the factory's task")
+	}
+}
+
+func TestSynchronizerSetTrustedHeadRejectsBackwards(t *testing.T) {
+	s := NewSynchronizer()
+	s.SetBeaconTaskFactory(func(header types.IHeader) Task {
+		return &fakeTask{peerID: "beacon", header: header, beacon: true}
+	})
+
+	if err := s.SetTrustedHead(&fakeHeader{num: 10}); err != nil {
+		t.Fatalf("SetTrustedHead: %v", err)
+	}
+	if err := s.SetTrustedHead(&fakeHeader{num: 5}); err == nil {
+		t.Fatalf("expected SetTrustedHead to reject moving the trusted head backwards")
+	}
+}
+
+func TestSynchronizerAddTaskRejectsTasksConflictingWithTrustedHead(t *testing.T) {
+	s := NewSynchronizer()
+	s.SetBeaconTaskFactory(func(header types.IHeader) Task {
+		return &fakeTask{peerID: "beacon", header: header, beacon: true}
+	})
+
+	if err := s.SetTrustedHead(&fakeHeader{num: 100}); err != nil {
+		t.Fatalf("SetTrustedHead: %v", err)
+	}
+	if got := s.NextTask(); got == nil || got.PeerID() != "beacon" {
+		t.Fatalf("expected the beacon task to be queued")
+	}
+
+	rival := &fakeTask{peerID: "rival", header: &fakeHeader{num: 100, variant: 1}}
+	s.AddTask(rival)
+	if got := s.tasks.Len(); got != 0 {
+		t.Fatalf("expected a task at or below the trusted head to be dropped, queue has %d tasks", got)
+	}
+
+	ahead := &fakeTask{peerID: "ahead", header: &fakeHeader{num: 101}}
+	s.AddTask(ahead)
+	if got := s.NextTask(); got == nil || got.PeerID() != "ahead" {
+		t.Fatalf("expected a task past the trusted head to be queued")
+	}
+}
+
+func TestSynchronizerSetTrustedHeadWithoutFactory(t *testing.T) {
+	s := NewSynchronizer()
+	if err := s.SetTrustedHead(&fakeHeader{num: 1}); err == nil {
+		t.Fatalf("expected an error when no BeaconTaskFactory is configured")
+	}
+}
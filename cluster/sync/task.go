@@ -2,7 +2,6 @@ package sync
 
 import (
 	"errors"
-	"fmt"
 	"math/big"
 	"strings"
 
@@ -22,18 +21,28 @@ const (
 // Task represents a synchronization task for the synchronizer.
 type Task interface {
 	SetSendFunc(func(value interface{}) int)
+	SetPeerPool(PeerPool)
 	Run(blockchain) error
 	Priority() *big.Int
 	PeerID() string
+	TargetHeader() types.IHeader
 }
 
+// priorityHeightBits is how many low-order bits of Priority() are reserved
+// for the total-difficulty tiebreaker, leaving the remaining high-order bits
+// for the block height. 128 bits is far more than any realistic TD needs.
+const priorityHeightBits = 128
+
 type task struct {
 	name             string
 	maxSyncStaleness uint64
 	batchSize        int
+	peerID           string
 
-	header types.IHeader
-	send   func(value interface{}) (nsent int)
+	header        types.IHeader
+	trustedHeader types.IHeader // set by NewBeaconTask; seals up to and including this header are already consensus-checked
+	send          func(value interface{}) (nsent int)
+	pool          PeerPool
 
 	findAncestor func(blockchain) (types.IHeader, error)
 	getHeaders   func(types.IHeader) ([]types.IHeader, error)
@@ -42,6 +51,49 @@ type task struct {
 	needSkip     func(b blockchain) bool
 }
 
+// Priority reports the task's ordering weight for the synchronizer's task
+// queue. QuarkChain's root chain (and, by extension, its shards) pick the
+// canonical chain by height/PoSW rather than classical cumulative PoW
+// difficulty, so ordering purely by total difficulty can make the
+// synchronizer prefer a stale peer that mined a few high-difficulty blocks
+// on a shorter chain. Priority is therefore height-first, with total
+// difficulty only breaking ties between two tasks targeting the same
+// height. Peers on older, TD-only versions of the protocol still interop
+// fine here: their advertised TD simply becomes the tiebreaker, since height
+// is always derived from the downloaded header rather than trusted from the
+// peer's status message.
+func (t *task) Priority() *big.Int {
+	height := new(big.Int).SetUint64(t.header.NumberU64())
+	height.Lsh(height, priorityHeightBits)
+
+	td := t.header.GetDifficulty()
+	if td == nil {
+		td = new(big.Int)
+	}
+	mask := new(big.Int).Sub(new(big.Int).Lsh(big.NewInt(1), priorityHeightBits), big.NewInt(1))
+	tiebreak := new(big.Int).And(td, mask)
+
+	return height.Or(height, tiebreak)
+}
+
+// PeerID returns the id of the peer this task was created to sync against.
+func (t *task) PeerID() string {
+	return t.peerID
+}
+
+// TargetHeader returns the header this task is trying to sync the chain up
+// to, so the synchronizer can dedupe tasks racing for the same target.
+func (t *task) TargetHeader() types.IHeader {
+	return t.header
+}
+
+// SetPeerPool gives the task access to every peer the synchronizer knows
+// about, beyond the single peer it was created for, so it can spread header
+// and block downloads across all of them instead of stalling on one.
+func (t *task) SetPeerPool(pool PeerPool) {
+	t.pool = pool
+}
+
 // Run will execute the synchronization task.
 func (t *task) Run(bc blockchain) error {
 	if t.needSkip(bc) {
@@ -63,73 +115,13 @@ func (t *task) Run(bc blockchain) error {
 		return nil
 	}
 
-	for !qkcom.IsNil(ancestor) {
-		headers, err := t.getHeaders(ancestor)
-		if err != nil {
-			return err
-		}
-		if len(headers) == 0 {
-			return nil
-		}
-
-		if err := t.validateHeaderList(bc, headers); err != nil {
-			return err
-		}
-
-		logger.Info("Downloading blocks", "length", len(headers), "from", ancestor.NumberU64(), "to", headers[len(headers)-1].NumberU64(),"t.header",t.header.NumberU64())
-
-		hashlist := make([]common.Hash, 0, len(headers))
-		for _, hd := range headers {
-			hashlist = append(hashlist, hd.Hash())
-		}
-
-		for len(hashlist) > 0 {
-			var blocks []types.IBlock
-			if len(hashlist) > t.batchSize {
-				blocks, err = t.getBlocks(hashlist[:t.batchSize])
-				if err != nil {
-					log.Error("getBlocks-1", "err",err)
-					return err
-				}
-				if len(blocks) != t.batchSize {
-					return fmt.Errorf("unmatched block length-1, expect: %d, actual: %d", t.batchSize, len(blocks))
-				}
-				hashlist = hashlist[t.batchSize:]
-			} else {
-				blocks, err = t.getBlocks(hashlist)
-				if err != nil {
-					log.Error("getBlocks-2", "err", err)
-					return err
-				}
-				if len(blocks) != len(hashlist) {
-					return fmt.Errorf("unmatched block length-2, expect: %d, actual: %d hash:%v", len(hashlist), len(blocks), hashlist[0].String())
-				}
-				hashlist = nil
-			}
-
-			if err != nil {
-				return err
-			}
+	var q *queue
+	if t.pool != nil && len(t.pool.Peers()) > 1 {
+		q = newQueue(t.pool, t.batchSize)
+	}
 
-			counter := 0
-			for _, blk := range blocks {
-				if t.syncBlock != nil {
-					if err := t.syncBlock(bc, blk); err != nil {
-						return err
-					}
-				}
-				if err := bc.AddBlock(blk); err != nil {
-					return err
-				}
-
-				counter++
-				if counter%100 == 0 {
-					t.sendSync(true, blk.NumberU64(), blocks[len(blocks)-1].NumberU64())
-				}
-
-				ancestor = blk.IHeader()
-			}
-		}
+	if err := t.runPipeline(bc, ancestor, q, logger); err != nil {
+		return err
 	}
 
 	// end to sync task
@@ -156,6 +148,37 @@ func (t *task) sendSync(syncing bool, curr, best uint64) {
 	}
 }
 
+// fetchHeaders downloads the next batch of headers past ancestor. When the
+// synchronizer has more than one peer registered, it fetches a skeleton from
+// the best peer and fills the gaps in parallel across every idle peer;
+// otherwise it falls back to the task's single-peer fetcher.
+func (t *task) fetchHeaders(q *queue, ancestor types.IHeader) ([]types.IHeader, error) {
+	if q == nil {
+		return t.getHeaders(ancestor)
+	}
+	skeleton, err := q.fetchSkeleton(ancestor)
+	if err != nil {
+		log.Warn("sync task: skeleton fetch failed, falling back to single-peer download", "err", err)
+		return t.getHeaders(ancestor)
+	}
+	return q.fill(skeleton, ancestor, t.getHeaders)
+}
+
+// fetchBlocks downloads bodies for hashlist, spreading the request across
+// every registered peer when possible and falling back to the task's
+// single-peer fetcher otherwise.
+func (t *task) fetchBlocks(q *queue, hashlist []common.Hash) ([]types.IBlock, error) {
+	if q == nil {
+		return t.getBlocks(hashlist)
+	}
+	blocks, err := q.fetchBlocks(hashlist)
+	if err != nil {
+		log.Warn("sync task: multi-peer block fetch failed, falling back to single-peer download", "err", err)
+		return t.getBlocks(hashlist)
+	}
+	return blocks, nil
+}
+
 func (t *task) validateHeaderList(bc blockchain, headers []types.IHeader) error {
 	var prev types.IHeader
 	for _, h := range headers {
@@ -167,8 +190,10 @@ func (t *task) validateHeaderList(bc blockchain, headers []types.IHeader) error
 				return errors.New("should have blocks correctly linked")
 			}
 		}
-		if err := bc.Validator().ValidateSeal(h, false); err != nil { //use diff/20
-			return err
+		if qkcom.IsNil(t.trustedHeader) || h.NumberU64() > t.trustedHeader.NumberU64() {
+			if err := bc.Validator().ValidateSeal(h, false); err != nil { //use diff/20
+				return err
+			}
 		}
 		prev = h
 	}
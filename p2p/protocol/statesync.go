@@ -0,0 +1,51 @@
+package protocol
+
+import (
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// Message codes for the state-sync extension. They slot in right after the
+// existing header/body exchange codes used by the block-sync protocol.
+const (
+	GetNodeDataMsg = 0x0d
+	NodeDataMsg    = 0x0e
+)
+
+// MaxNodeDataFetch bounds how many trie nodes a single GetNodeDataMsg may
+// request, mirroring the caps already in place for header/body batches.
+const MaxNodeDataFetch = 384
+
+// GetNodeDataRequest asks a peer for the raw preimages behind a list of trie
+// node hashes.
+type GetNodeDataRequest struct {
+	Hashes []common.Hash
+}
+
+// NodeDataResponse carries the blobs requested by a GetNodeDataRequest. A
+// peer missing a node omits it rather than padding the slice.
+type NodeDataResponse struct {
+	Data [][]byte
+}
+
+// NodeDataPeer is implemented by any connected peer capable of serving
+// state-sync trie node requests.
+type NodeDataPeer interface {
+	ID() string
+	RequestNodeData(hashes []common.Hash) error
+}
+
+// NodeDataSink accepts the blobs a peer sent back in a NodeDataMsg, e.g. a
+// statesync.Scheduler for the pivot currently being downloaded.
+type NodeDataSink interface {
+	Deliver(peerID string, blobs [][]byte) (int, error)
+}
+
+// HandleNodeData is the dispatch-side counterpart to RequestNodeData: a
+// peer's message loop should call it for every NodeDataMsg it receives, so
+// the reply reaches whichever sink is currently downloading state.
+func HandleNodeData(peerID string, resp *NodeDataResponse, sink NodeDataSink) (int, error) {
+	if sink == nil {
+		return 0, nil
+	}
+	return sink.Deliver(peerID, resp.Data)
+}
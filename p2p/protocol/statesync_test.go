@@ -0,0 +1,40 @@
+package protocol
+
+import "testing"
+
+type fakeSink struct {
+	peerID string
+	blobs  [][]byte
+}
+
+func (f *fakeSink) Deliver(peerID string, blobs [][]byte) (int, error) {
+	f.peerID = peerID
+	f.blobs = blobs
+	return len(blobs), nil
+}
+
+func TestHandleNodeDataForwardsToSink(t *testing.T) {
+	sink := &fakeSink{}
+	resp := &NodeDataResponse{Data: [][]byte{{1, 2, 3}}}
+
+	n, err := HandleNodeData("peer1", resp, sink)
+	if err != nil {
+		t.Fatalf("HandleNodeData: %v", err)
+	}
+	if n != 1 {
+		t.Fatalf("expected 1 blob delivered, got %d", n)
+	}
+	if sink.peerID != "peer1" {
+		t.Errorf("expected sink to see peer1, got %q", sink.peerID)
+	}
+}
+
+func TestHandleNodeDataNilSink(t *testing.T) {
+	n, err := HandleNodeData("peer1", &NodeDataResponse{Data: [][]byte{{1}}}, nil)
+	if err != nil {
+		t.Fatalf("HandleNodeData: %v", err)
+	}
+	if n != 0 {
+		t.Fatalf("expected 0 with nil sink, got %d", n)
+	}
+}